@@ -3,16 +3,24 @@ package simpletransport
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/tsenart/tb"
+	"golang.org/x/net/http2"
 )
 
 // SimpleTransport is an HTTP RoundTripper that doesn't pool connections. Most of this is ripped from http.Transport.
@@ -23,12 +31,65 @@ type SimpleTransport struct {
 	// RequestTimeout isn't exact. In the worst case, the actual timeout can come at RequestTimeout * 2.
 	RequestTimeout time.Duration
 	totalTokens    int64
+
+	// DialContext specifies the dial function for creating unencrypted TCP
+	// connections. If DialContext is nil, a net.Dialer honoring
+	// ConnectionTimeout is used.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// DialTLSContext specifies an optional dial function for creating TLS
+	// connections for https requests. If DialTLSContext is set, it takes
+	// precedence over DialContext and TLSClientConfig, and the returned
+	// connection is used as-is without SimpleTransport performing its own
+	// handshake. DialTLSContext is not used for requests sent through a
+	// Proxy; those dial the proxy with DialContext and handshake using
+	// TLSClientConfig.
+	DialTLSContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// TLSClientConfig specifies the TLS configuration used for https
+	// requests when DialTLSContext is nil or the request is sent through a
+	// Proxy. If nil, a zero-value tls.Config is used.
+	TLSClientConfig *tls.Config
+
+	// Proxy specifies a function to return a proxy for a given request. If
+	// the function returns a non-nil error, the request is aborted with
+	// that error. If Proxy is nil, requests are made directly to the
+	// origin server.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// ForceAttemptHTTP2 opts into advertising and accepting HTTP/2 for
+	// https requests via ALPN during the TLS handshake. If the server
+	// negotiates "h2", the request is completed over
+	// golang.org/x/net/http2 instead of SimpleTransport's own HTTP/1
+	// framing; otherwise it falls back to the existing HTTP/1 path. The
+	// ConnectionTimeout/ReadTimeout/RequestTimeout wrappers still apply to
+	// the underlying net.Conn either way.
+	ForceAttemptHTTP2 bool
+
+	// MaxRetries bounds how many times an idempotent request is retried,
+	// over a freshly dialed connection, after a connection-reset-like
+	// error that occurs before any response bytes are read. Zero means the
+	// default of 1 retry.
+	MaxRetries int
+}
+
+// ProxyFromEnvironment is a Proxy func that reads the HTTP_PROXY,
+// HTTPS_PROXY and NO_PROXY environment variables (or their lowercase
+// equivalents), exactly as http.ProxyFromEnvironment does.
+func ProxyFromEnvironment(req *http.Request) (*url.URL, error) {
+	return http.ProxyFromEnvironment(req)
 }
 
 // ThrottleTransport is an HTTP RoundTripper that uses a SimpleTransport but throttles the requests.
 type ThrottleTransport struct {
 	SimpleTransport
 	throttler *tb.Throttler
+	keyFunc   func(*http.Request) string
+	burst     int64
+	maxWait   time.Duration
+
+	permitsMu sync.Mutex
+	permits   map[string]chan struct{}
 }
 
 // ThrottleOptions are the options to create a new throttle transport
@@ -38,6 +99,21 @@ type ThrottleOptions struct {
 	RequestTimeout    time.Duration
 	ConnectionTimeout time.Duration
 	TotalTokens       int64
+
+	// KeyFunc returns the throttle bucket key for a request, so requests to
+	// different hosts are throttled independently instead of sharing a
+	// single bucket. Defaults to req.URL.Host.
+	KeyFunc func(*http.Request) string
+
+	// Burst allows a key's bucket to hold this many tokens above
+	// TotalTokens, so short bursts above the steady-state rate don't get
+	// throttled. Zero means no extra burst capacity.
+	Burst int64
+
+	// MaxWait bounds how long RoundTrip will wait for a token to become
+	// available. If a wait would exceed MaxWait, RoundTrip returns an error
+	// instead of blocking. Zero means wait indefinitely.
+	MaxWait time.Duration
 }
 
 // NewThrottleTransport setups and returns a ThrottleTransport
@@ -46,6 +122,11 @@ func NewThrottleTransport(opt *ThrottleOptions) *ThrottleTransport {
 		panic("Throttle rate cannot be less than a second")
 	}
 
+	keyFunc := opt.KeyFunc
+	if keyFunc == nil {
+		keyFunc = func(req *http.Request) string { return req.URL.Host }
+	}
+
 	s := SimpleTransport{
 		ReadTimeout:       opt.ReadTimeout,
 		RequestTimeout:    opt.RequestTimeout,
@@ -55,15 +136,82 @@ func NewThrottleTransport(opt *ThrottleOptions) *ThrottleTransport {
 	return &ThrottleTransport{
 		throttler:       tb.NewThrottler(opt.ThrottleRate),
 		SimpleTransport: s,
+		keyFunc:         keyFunc,
+		burst:           opt.Burst,
+		maxWait:         opt.MaxWait,
 	}
 
 }
 
 func (t *ThrottleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	t.throttler.Wait("request", 1, t.totalTokens)
+	if err := t.acquire(t.keyFunc(req)); err != nil {
+		return nil, err
+	}
+
 	return t.SimpleTransport.RoundTrip(req)
 }
 
+// acquire blocks until a token for key is available, or returns an error
+// once MaxWait has elapsed. When MaxWait is exceeded, the throttler.Wait
+// call already in flight keeps running in the background and will
+// eventually earn a token for a request that has since given up; rather
+// than let that token vanish, it's parked on a per-key permit channel so
+// the next acquire for the same key picks it up instead of waiting on the
+// throttler again.
+func (t *ThrottleTransport) acquire(key string) error {
+	permits := t.permitChan(key)
+
+	select {
+	case <-permits:
+		return nil
+	default:
+	}
+
+	if t.maxWait <= 0 {
+		t.throttler.Wait(key, 1, t.totalTokens+t.burst)
+		return nil
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		t.throttler.Wait(key, 1, t.totalTokens+t.burst)
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		return nil
+	case <-time.After(t.maxWait):
+		// Bank the token this Wait call will eventually earn so it isn't
+		// wasted on an attempt the caller already abandoned.
+		go func() {
+			<-waited
+			select {
+			case permits <- struct{}{}:
+			default:
+			}
+		}()
+		return fmt.Errorf("simpletransport: throttle wait for %q exceeded MaxWait of %s", key, t.maxWait)
+	}
+}
+
+// permitChan returns the buffered, single-slot permit channel used to bank
+// a token for key across acquire calls.
+func (t *ThrottleTransport) permitChan(key string) chan struct{} {
+	t.permitsMu.Lock()
+	defer t.permitsMu.Unlock()
+
+	if t.permits == nil {
+		t.permits = make(map[string]chan struct{})
+	}
+	ch, ok := t.permits[key]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		t.permits[key] = ch
+	}
+	return ch
+}
+
 func (t *SimpleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	switch {
 	case req.URL == nil:
@@ -76,12 +224,85 @@ func (t *SimpleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		return nil, errors.New("http: no Host in request URL")
 	}
 
-	conn, err := t.dial(req)
+	var proxyURL *url.URL
+	if t.Proxy != nil {
+		var err error
+		proxyURL, err = t.Proxy(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxRetries := t.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = 1
+	}
+
+	for retries := 0; ; retries++ {
+		resp, retryable, err := t.roundTripOnce(req, proxyURL)
+		if err == nil {
+			return resp, nil
+		}
+
+		if !retryable || retries >= maxRetries || !isIdempotent(req) {
+			return nil, err
+		}
+
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			req.Body = body
+		}
+	}
+}
+
+// roundTripOnce performs a single attempt at req over a fresh connection. It
+// also reports whether the attempt is safe to retry on a fresh connection,
+// which RoundTrip uses together with MaxRetries/isIdempotent.
+func (t *SimpleTransport) roundTripOnce(req *http.Request, proxyURL *url.URL) (*http.Response, bool, error) {
+	ctx := req.Context()
+	trace := httptrace.ContextClientTrace(ctx)
+
+	conn, isH2, err := t.dial(ctx, req, proxyURL)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+
+	if isH2 {
+		// HTTP/2 streams don't cleanly separate "nothing written" from
+		// "partially read" errors, so treat any failure here as unsafe to
+		// retry.
+		resp, err := t.roundTripH2(conn, req)
+		return resp, false, err
 	}
 
-	reader := bufio.NewReader(conn)
+	// Close the connection out from under the write/read goroutines as soon
+	// as the request's context is canceled, so callers don't have to wait
+	// for ReadTimeout/RequestTimeout to unblock.
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stopWatch:
+		}
+	}()
+
+	var gotFirstByte int32
+	connReader := io.Reader(&traceFirstByteReader{Reader: conn, fn: func() {
+		atomic.StoreInt32(&gotFirstByte, 1)
+		if trace != nil && trace.GotFirstResponseByte != nil {
+			trace.GotFirstResponseByte()
+		}
+	}})
+
+	reader := bufio.NewReader(connReader)
 	writer := bufio.NewWriter(conn)
 	readDone := make(chan responseAndError, 1)
 	writeDone := make(chan error, 1)
@@ -89,12 +310,36 @@ func (t *SimpleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	// Always request GZIP.
 	req.Header.Set("Accept-Encoding", "gzip")
 
-	// Write the request.
+	proxiedHTTP := proxyURL != nil && req.URL.Scheme == "http"
+
+	// writeReq is what actually goes out on the wire. A RoundTripper must
+	// not mutate the caller's *http.Request, so when a Proxy-Authorization
+	// header needs adding, write a clone instead of req itself.
+	writeReq := req
+	if proxiedHTTP && proxyURL.User != nil {
+		writeReq = req.Clone(ctx)
+		writeReq.Header.Set("Proxy-Authorization", "Basic "+basicAuth(proxyURL.User))
+	}
+
+	// Write the request. Requests proxied over plain http are written in
+	// absolute-URI form, as the proxy expects.
 	go func() {
-		err := req.Write(writer)
+		var err error
+		if proxiedHTTP {
+			err = writeReq.WriteProxy(writer)
+		} else {
+			err = writeReq.Write(writer)
+		}
 
 		if err == nil {
-			writer.Flush()
+			err = writer.Flush()
+		}
+
+		if trace != nil && trace.WroteHeaders != nil {
+			trace.WroteHeaders()
+		}
+		if trace != nil && trace.WroteRequest != nil {
+			trace.WroteRequest(httptrace.WroteRequestInfo{Err: err})
 		}
 
 		writeDone <- err
@@ -130,26 +375,248 @@ func (t *SimpleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	}()
 
 	if err = <-writeDone; err != nil {
-		return nil, err
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, false, ctxError(req, ctx.Err())
+		}
+		// Nothing coherent reached the server, so it's always safe to retry.
+		return nil, shouldRetryRequest(false, false, err), err
 	}
 
 	r := <-readDone
 
 	if r.err != nil {
-		return nil, r.err
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, false, ctxError(req, ctx.Err())
+		}
+		return nil, shouldRetryRequest(true, atomic.LoadInt32(&gotFirstByte) == 1, r.err), r.err
+	}
+
+	return r.res, false, nil
+}
+
+// ctxError wraps a context error the way http.Client would, so callers can
+// detect cancellation/deadline errors with the usual *url.Error unwrapping.
+func ctxError(req *http.Request, err error) error {
+	return &url.Error{Op: req.Method, URL: req.URL.String(), Err: err}
+}
+
+// isIdempotent reports whether req is safe to replay on a fresh connection.
+// Mirroring net/http's isReplayable, the method alone isn't enough: a
+// PUT/DELETE with a body only qualifies if that body can actually be
+// resent, either because there isn't one or because GetBody lets us
+// recreate it. Without that check a body already drained by a fully
+// written request would be replayed empty, silently corrupting it.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
 	}
+	return false
+}
 
-	return r.res, nil
+// shouldRetryRequest reports whether a failed attempt is safe to retry,
+// mirroring net/http's nothingWrittenError/connResetError classification:
+// retry when nothing reached the server (wroteRequest is false, meaning the
+// request was never fully written), or when the connection was reset or
+// closed by the server before any response byte arrived. A read timeout
+// that occurs after the request was fully sent and a response has started
+// arriving does not qualify, since the server may already have acted on
+// the request.
+func shouldRetryRequest(wroteRequest, gotFirstByte bool, err error) bool {
+	if !wroteRequest {
+		return true
+	}
+	if gotFirstByte {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 }
 
-func (t *SimpleTransport) dial(req *http.Request) (net.Conn, error) {
+// dial establishes the connection for req, performing the TLS handshake for
+// https requests. It reports whether the connection negotiated HTTP/2 via
+// ALPN, in which case the caller must hand off to roundTripH2 instead of
+// SimpleTransport's own HTTP/1 framing.
+func (t *SimpleTransport) dial(ctx context.Context, req *http.Request, proxyURL *url.URL) (net.Conn, bool, error) {
 	targetAddr := canonicalAddr(req.URL)
+	trace := httptrace.ContextClientTrace(ctx)
+
+	if req.URL.Scheme == "https" && proxyURL == nil && t.DialTLSContext != nil {
+		c, err := t.DialTLSContext(ctx, "tcp", targetAddr)
+		if err != nil {
+			return nil, false, err
+		}
+
+		// Inspect NegotiatedProtocol before wrapTimeouts, which wraps c in a
+		// deadlineConn/timeoutConn and would hide the underlying *tls.Conn
+		// from this type assertion.
+		isH2 := false
+		if t.ForceAttemptHTTP2 {
+			if tc, ok := c.(*tls.Conn); ok {
+				isH2 = tc.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+			}
+		}
+
+		return t.wrapTimeouts(c), isH2, nil
+	}
+
+	dialAddr := targetAddr
+	if proxyURL != nil {
+		dialAddr = canonicalAddr(proxyURL)
+	}
+
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: t.ConnectionTimeout}).DialContext
+	}
+
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart("tcp", dialAddr)
+	}
+	c, err := dial(ctx, "tcp", dialAddr)
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone("tcp", dialAddr, err)
+	}
+	if err != nil {
+		return c, false, err
+	}
+
+	c = t.wrapTimeouts(c)
+
+	if proxyURL != nil && req.URL.Scheme == "https" {
+		tunnel, err := connectThroughProxy(c, proxyURL, targetAddr)
+		if err != nil {
+			c.Close()
+			return nil, false, err
+		}
+		c = tunnel
+	}
+
+	isH2 := false
+
+	if req.URL.Scheme == "https" {
+		serverName := hostname(req.URL.Host)
+
+		cfg := cloneTLSConfig(t.TLSClientConfig)
+		if cfg.ServerName == "" {
+			cfg.ServerName = serverName
+		}
+		if t.ForceAttemptHTTP2 && len(cfg.NextProtos) == 0 {
+			cfg.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+		}
 
-	c, err := net.DialTimeout("tcp", targetAddr, t.ConnectionTimeout)
+		c = tls.Client(c, cfg)
+
+		if trace != nil && trace.TLSHandshakeStart != nil {
+			trace.TLSHandshakeStart()
+		}
+
+		err = c.(*tls.Conn).Handshake()
+
+		if trace != nil && trace.TLSHandshakeDone != nil {
+			trace.TLSHandshakeDone(c.(*tls.Conn).ConnectionState(), err)
+		}
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		if err = c.(*tls.Conn).VerifyHostname(serverName); err != nil {
+			return nil, false, err
+		}
+
+		isH2 = t.ForceAttemptHTTP2 && c.(*tls.Conn).ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+	}
+
+	return c, isH2, nil
+}
+
+// roundTripH2 completes req over conn, an already-established connection
+// that negotiated HTTP/2 via ALPN. SimpleTransport speaks HTTP/1 framing
+// itself, so HTTP/2 is delegated entirely to x/net/http2.
+func (t *SimpleTransport) roundTripH2(conn net.Conn, req *http.Request) (*http.Response, error) {
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := cc.RoundTrip(req)
 	if err != nil {
-		return c, err
+		conn.Close()
+		return nil, err
 	}
 
+	// x/net's h2 response body doesn't close cc or conn, so without this the
+	// ClientConn's read-loop goroutine and the underlying connection would
+	// live until ReadTimeout/RequestTimeout fired, or leak forever with
+	// neither set.
+	body := resp.Body
+	resp.Body = &readerAndCloser{body, closerFunc(func() error {
+		bodyErr := body.Close()
+		ccErr := cc.Close()
+		if bodyErr != nil {
+			return bodyErr
+		}
+		return ccErr
+	})}
+
+	return resp, nil
+}
+
+// closerFunc adapts a func() error to io.Closer.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// connectThroughProxy issues an HTTP CONNECT request over c, asking the
+// proxy at proxyURL to open a tunnel to targetAddr, and returns c once the
+// tunnel is established. c is positioned right after the CONNECT response,
+// ready for the TLS handshake with the origin server.
+func connectThroughProxy(c net.Conn, proxyURL *url.URL, targetAddr string) (net.Conn, error) {
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: targetAddr},
+		Host:   targetAddr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+basicAuth(proxyURL.User))
+	}
+
+	if err := connectReq.Write(c); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, connectReq)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("simpletransport: proxy CONNECT to %s returned %s", targetAddr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return nil, errors.New("simpletransport: proxy sent data before CONNECT response completed")
+	}
+
+	return c, nil
+}
+
+// basicAuth base64-encodes user for use in a Proxy-Authorization header.
+func basicAuth(user *url.Userinfo) string {
+	username := user.Username()
+	password, _ := user.Password()
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// wrapTimeouts applies ReadTimeout/RequestTimeout, if configured, to a
+// freshly dialed connection.
+func (t *SimpleTransport) wrapTimeouts(c net.Conn) net.Conn {
 	if t.RequestTimeout > 0 && t.ReadTimeout == 0 {
 		t.ReadTimeout = t.RequestTimeout
 	}
@@ -162,19 +629,30 @@ func (t *SimpleTransport) dial(req *http.Request) (net.Conn, error) {
 		}
 	}
 
-	if req.URL.Scheme == "https" {
-		c = tls.Client(c, &tls.Config{ServerName: req.URL.Host})
-
-		if err = c.(*tls.Conn).Handshake(); err != nil {
-			return nil, err
-		}
+	return c
+}
 
-		if err = c.(*tls.Conn).VerifyHostname(req.URL.Host); err != nil {
-			return nil, err
-		}
+// cloneTLSConfig returns a copy of cfg suitable for mutating per-request, or
+// a zero-value config if cfg is nil.
+func cloneTLSConfig(cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		return &tls.Config{}
 	}
+	return cfg.Clone()
+}
 
-	return c, nil
+// hostname strips an optional ":port" suffix from host, for use as the TLS
+// ServerName/VerifyHostname argument. req.URL.Host includes the port, which
+// tls.Config.ServerName must not.
+func hostname(host string) string {
+	if !hasPort(host) {
+		return host
+	}
+	h, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	return h
 }
 
 // canonicalAddr returns url.Host but always with a ":port" suffix
@@ -199,6 +677,23 @@ type readerAndCloser struct {
 	io.Closer
 }
 
+// traceFirstByteReader wraps a connection's reader and invokes fn once,
+// on the first successfully read byte, to drive httptrace's
+// GotFirstResponseByte hook.
+type traceFirstByteReader struct {
+	io.Reader
+	once sync.Once
+	fn   func()
+}
+
+func (r *traceFirstByteReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.once.Do(r.fn)
+	}
+	return n, err
+}
+
 type responseAndError struct {
 	res *http.Response
 	err error
@@ -38,35 +38,59 @@ func TestThrottle(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 
-	transport := NewThrottleTransport(time.Second*3, time.Second*30, time.Second*30)
-
-	go func(ttransport *ThrottleTransport) {
-		defer wg.Done()
-		req, _ := http.NewRequest("GET", "https://google.com", nil)
-		res, err := transport.RoundTrip(req)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		body, _ := ioutil.ReadAll(res.Body)
-		if string(body) == "" {
-			t.Error("Body is empty")
-		}
-	}(transport)
-
-	go func(transport *ThrottleTransport) {
-		defer wg.Done()
-		req, _ := http.NewRequest("GET", "https://google.com", nil)
-		res, err := transport.RoundTrip(req)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		body, _ := ioutil.ReadAll(res.Body)
-		if string(body) == "" {
-			t.Error("Body is empty")
-		}
-	}(transport)
+	transport := NewThrottleTransport(&ThrottleOptions{
+		ThrottleRate:      time.Second * 3,
+		ReadTimeout:       time.Second * 30,
+		RequestTimeout:    time.Second * 30,
+		ConnectionTimeout: time.Second * 30,
+		TotalTokens:       1,
+	})
+
+	for i := 0; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "https://google.com", nil)
+			res, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if string(body) == "" {
+				t.Error("Body is empty")
+			}
+		}()
+	}
 
 	wg.Wait()
 }
+
+func TestThrottleKeyFuncDefault(t *testing.T) {
+	transport := NewThrottleTransport(&ThrottleOptions{
+		ThrottleRate: time.Second,
+		TotalTokens:  1,
+	})
+
+	req, _ := http.NewRequest("GET", "https://example.com/foo", nil)
+	if got, want := transport.keyFunc(req), "example.com"; got != want {
+		t.Errorf("default keyFunc(req) = %q, want %q", got, want)
+	}
+}
+
+func TestThrottleMaxWait(t *testing.T) {
+	transport := NewThrottleTransport(&ThrottleOptions{
+		ThrottleRate: time.Hour,
+		TotalTokens:  1,
+		MaxWait:      20 * time.Millisecond,
+	})
+
+	if err := transport.acquire("example.com"); err != nil {
+		t.Fatalf("first acquire: unexpected error: %v", err)
+	}
+
+	if err := transport.acquire("example.com"); err == nil {
+		t.Fatal("second acquire: expected a MaxWait timeout error, got nil")
+	}
+}